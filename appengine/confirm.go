@@ -0,0 +1,235 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+	"appengine/delay"
+	"appengine/taskqueue"
+	"appengine/urlfetch"
+	"google.golang.org/api/googleapi"
+	storage "google.golang.org/api/storage/v1"
+)
+
+// thumbnailSuffix mirrors ThumbnailSuffix in compute/web-process-image.go; it's how the worker
+// names its output object, and confirmTransform needs to check for that exact name.
+const thumbnailSuffix = "-t"
+
+const (
+	// expectedTransformLatency is how long a transform normally takes end to end, including
+	// however long the message waits in the subscription for a worker to pull it.
+	expectedTransformLatency = 10 * time.Second
+	// confirmDelay is how long after publishing we wait before checking whether the output
+	// object showed up. It's set generously above expectedTransformLatency so a healthy,
+	// merely-busy worker pool isn't mistaken for one that dropped the work.
+	confirmDelay = 2 * expectedTransformLatency
+	// maxConfirmAttempts bounds how many attempts a transform gets, counting the original
+	// dispatch, before we give up and leave its job record for an operator to look at.
+	maxConfirmAttempts = 5
+)
+
+var confirmTransformFunc = delay.Func("confirmTransform", confirmTransform)
+
+// transformJobRecord is a Datastore record of an in-flight (or failed) transform, keyed by the
+// message ID (bucket/object). Its presence prevents a duplicate GCS notification for the same
+// object from dispatching a second job while one is already outstanding, and gives operators a
+// place to look for work that got stuck because its assigned VM disappeared.
+type transformJobRecord struct {
+	Bucket       string
+	Object       string
+	SaveToBucket string
+	Generation   string
+	Attempt      int
+	Status       string
+	CreatedAt    time.Time
+}
+
+// jobKey returns the Datastore key a transformJobRecord for the given key string is stored under.
+func jobKey(c appengine.Context, key string) *datastore.Key {
+	return datastore.NewKey(c, "TransformJob", key, 0, nil)
+}
+
+// jobRecordKey returns the Datastore key identity msg's transformJobRecord is stored under:
+// msg.ID alone for legacy single-variant dispatch, or msg.ID plus its pipeline/step for a
+// pipeline step, so each step of a multi-step pipeline gets its own confirmation record instead
+// of clobbering its siblings'. This is distinct from the bare-id key markJobPending writes at
+// dispatch time, so the two never collide.
+func jobRecordKey(msg transformMessage) string {
+	if msg.Pipeline == "" {
+		return msg.ID
+	}
+	return fmt.Sprintf("%s#%s:%d", msg.ID, msg.Pipeline, msg.Step)
+}
+
+// recordJob creates or overwrites the job record for msg, and schedules a confirmation check for
+// confirmDelay from now. A failure here is logged but not fatal to the request: better to risk a
+// duplicate dispatch or a missed confirmation than to drop the transform entirely.
+func recordJob(c appengine.Context, msg transformMessage) {
+	key := jobKey(c, jobRecordKey(msg))
+	record := transformJobRecord{
+		Bucket:       msg.Bucket,
+		Object:       msg.Object,
+		SaveToBucket: msg.SaveToBucket,
+		Generation:   msg.Generation,
+		Attempt:      msg.AttemptCount,
+		Status:       "pending",
+		CreatedAt:    time.Now(),
+	}
+	if _, err := datastore.Put(c, key, &record); err != nil {
+		c.Errorf("Unable to persist job record for %v: %v", msg.ID, err)
+	}
+
+	task, err := confirmTransformFunc.Task(msg)
+	if err != nil {
+		c.Errorf("Unable to build confirmation task for %v: %v", msg.ID, err)
+		return
+	}
+	task.Delay = confirmDelay
+	if _, err := taskqueue.Add(c, task, ""); err != nil {
+		c.Errorf("Unable to schedule confirmation for %v: %v", msg.ID, err)
+	}
+}
+
+// markJobPending writes a minimal "pending" placeholder for id without scheduling a confirmation
+// task. A pipeline's steps run asynchronously, queued behind their own named task queues, so
+// there would otherwise be a window between transformImage returning and its first step's task
+// actually running during which jobAlreadyHandled finds no record yet and a redelivered
+// notification dispatches the whole pipeline a second time. recordJob (called once the first
+// step's task runs) writes that step's own record under its per-step key (see jobRecordKey) and
+// is what actually schedules confirmTransform; this bare-id placeholder is left as it is until
+// confirmTransform carries it to "done" or "failed".
+func markJobPending(c appengine.Context, id string) {
+	record := transformJobRecord{Status: "pending", CreatedAt: time.Now()}
+	if _, err := datastore.Put(c, jobKey(c, id), &record); err != nil {
+		c.Errorf("Unable to persist placeholder job record for %v: %v", id, err)
+	}
+}
+
+// jobAlreadyHandled reports whether id already has an outstanding job, or has already completed
+// the given generation, so a duplicate or redelivered notification can be dropped instead of
+// dispatching the same work twice. Pass an empty generation to only check for an in-flight job.
+func jobAlreadyHandled(c appengine.Context, id, generation string) bool {
+	var record transformJobRecord
+	if err := datastore.Get(c, jobKey(c, id), &record); err != nil {
+		return false
+	}
+	if record.Status == "pending" {
+		return true
+	}
+	return generation != "" && record.Status == "done" && record.Generation == generation
+}
+
+// confirmTransform checks whether msg's output object has appeared in GCS; if not, it re-publishes
+// the transform (capped at maxConfirmAttempts) on the assumption the VM that pulled the original
+// message was removed by the autoscaler before it could finish.
+func confirmTransform(c appengine.Context, msg transformMessage) error {
+	// A pipeline step names its own output object via SaveToObject (resolved from its SaveTo
+	// template); only legacy single-variant messages fall back to the worker's suffix-based name.
+	saveToFilename := msg.SaveToObject
+	if saveToFilename == "" {
+		saveToFilename = outputFilename(msg.Object)
+	}
+	exists, err := objectExists(c, msg.SaveToBucket, saveToFilename)
+	if err != nil {
+		c.Errorf("confirmTransform: unable to check %v/%v: %v", msg.SaveToBucket, saveToFilename, err)
+		return err
+	}
+	if exists {
+		c.Infof("confirmTransform: %v confirmed present", msg.ID)
+		record := transformJobRecord{
+			Bucket: msg.Bucket, Object: msg.Object, SaveToBucket: msg.SaveToBucket,
+			Generation: msg.Generation, Attempt: msg.AttemptCount, Status: "done", CreatedAt: time.Now(),
+		}
+		// Status "done" (rather than deleting the record) is what lets a later redelivery of the
+		// same generation be recognized as already-processed by jobAlreadyHandled.
+		datastore.Put(c, jobKey(c, jobRecordKey(msg)), &record)
+		// markJobPending wrote the bare-id record jobAlreadyHandled actually consults; it must be
+		// carried to "done" too once the whole pipeline (not just this one step) has finished, or
+		// jobAlreadyHandled would see it stuck on "pending" forever and block every future
+		// notification for this object.
+		if isFinalStep(msg) {
+			datastore.Put(c, jobKey(c, msg.ID), &record)
+		}
+		// A pipeline step's own output only exists once it's confirmed here, so this is also the
+		// earliest point the chain's next step (if any) can safely read it as its source.
+		advancePipeline(c, msg, saveToFilename)
+		return nil
+	}
+
+	if msg.AttemptCount >= maxConfirmAttempts {
+		c.Errorf("confirmTransform: giving up on %v after %d attempts", msg.ID, msg.AttemptCount)
+		record := transformJobRecord{
+			Bucket: msg.Bucket, Object: msg.Object, SaveToBucket: msg.SaveToBucket,
+			Generation: msg.Generation, Attempt: msg.AttemptCount, Status: "failed", CreatedAt: time.Now(),
+		}
+		datastore.Put(c, jobKey(c, jobRecordKey(msg)), &record)
+		// Same reasoning as the "done" branch above: a giving-up step must also carry the bare-id
+		// record to a terminal state, or it's stuck on "pending" and blocks this object forever.
+		// A step that gives up ends its pipeline whether or not it is the final step, so this is
+		// done unconditionally.
+		datastore.Put(c, jobKey(c, msg.ID), &record)
+		return nil
+	}
+
+	c.Warningf("confirmTransform: %v missing %v after publish; re-dispatching (attempt %d)",
+		msg.ID, confirmDelay, msg.AttemptCount+1)
+	msg.AttemptCount++
+	if err := publishTransform(c, msg); err != nil {
+		c.Errorf("confirmTransform: unable to re-publish %v: %v", msg.ID, err)
+		return err
+	}
+	recordJob(c, msg)
+	return nil
+}
+
+// outputFilename returns the name the worker will save its output under for the given source
+// object name; it mirrors the suffix logic in compute/web-process-image.go's
+// processImageReqFromMessage.
+func outputFilename(objectName string) string {
+	ext := filepath.Ext(objectName)
+	name := objectName[:len(objectName)-len(ext)]
+	return name + thumbnailSuffix + ext
+}
+
+// objectExists reports whether bucket/name exists in GCS.
+func objectExists(c appengine.Context, bucket, name string) (bool, error) {
+	client := urlfetch.Client(c)
+	service, err := storage.New(client)
+	if err != nil {
+		return false, err
+	}
+	_, err = service.Objects.Get(bucket, name).Do()
+	if err != nil {
+		if isNotFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// isNotFound reports whether err is a GCS JSON API 404.
+func isNotFound(err error) bool {
+	if gerr, ok := err.(*googleapi.Error); ok {
+		return gerr.Code == http.StatusNotFound
+	}
+	return false
+}
@@ -17,29 +17,88 @@
 package main
 
 import (
+	"encoding/base64"
 	"encoding/json"
-	"errors"
+	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"appengine"
 	"appengine/delay"
 	"appengine/urlfetch"
+	pubsub "google.golang.org/api/pubsub/v1"
 )
 
-// Update these constants with values from your project!
-const (
-	// Bucket for storing generated thumbnails.
-	saveToBucketName = "fifth-curve-684-output-bucket"
-	// IP pointing to worker processing pool.
-	processingPoolIp = "107.178.243.219"
+// signedURLExpiry bounds how long a signed GCS download URL handed to a worker remains valid.
+// It should comfortably exceed the time a single transform takes, but not so long that a leaked
+// URL stays useful.
+const signedURLExpiry = 10 * time.Minute
+
+// Per-project configuration, set via app.yaml env_variables rather than hardcoded so the same
+// build can be deployed to more than one project.
+var (
+	// saveToBucketName is the bucket generated thumbnails are written to.
+	saveToBucketName = os.Getenv("SAVE_TO_BUCKET")
+	// transformTopic is the Pub/Sub topic workers pull transform requests from.
+	transformTopic = os.Getenv("TRANSFORM_TOPIC")
 )
 
+// transformMessage is the JSON payload published to transformTopic. Workers pull these messages
+// themselves, so the App Engine app never needs to know which (if any) worker VMs are alive.
+type transformMessage struct {
+	Bucket       string `json:"bucket"`
+	Object       string `json:"object"`
+	SaveToBucket string `json:"saveToBucket"`
+	ID           string `json:"id"`
+	AttemptCount int    `json:"attemptCount"`
+	// Transform names the variant the worker should produce; empty means the worker's default.
+	Transform string `json:"transform"`
+	// TraceID correlates this message's worker-side structured logs back to the originating
+	// request; empty if the frontend didn't see an X-Cloud-Trace-Context header.
+	TraceID string `json:"traceId"`
+	// Generation is the GCS object generation, fetched and validated against the JSON API rather
+	// than trusted from the notification body; it's what lets jobAlreadyHandled dedupe by
+	// generation rather than just by name.
+	Generation string `json:"generation"`
+	// SignedURL is a time-limited signed GCS download URL for Bucket/Object, so the worker need
+	// not hold GCS read credentials of its own. It is empty if signing failed, and always empty for
+	// a pipeline step after the first (see advancePipeline); the worker then falls back to an
+	// authenticated download using its own service account.
+	SignedURL string `json:"signedUrl,omitempty"`
+	// SaveToObject, if set, is the exact output object name a pipeline step resolved from its
+	// SaveTo template (see resolveSaveTo), overriding the worker's own suffix-based naming. Empty
+	// for legacy single-variant dispatch, where the worker still derives the output name itself.
+	SaveToObject string `json:"saveToObject,omitempty"`
+	// Op names a pipeline step's operation (e.g. "thumbnail", "moderate"); it's also copied into
+	// Transform so a worker dispatches on that single familiar field either way. Empty for legacy
+	// single-variant dispatch.
+	Op string `json:"op,omitempty"`
+	// Params carries a pipeline step's op-specific configuration verbatim from pipelines.json.
+	// Today's worker transforms don't take parameters, so this travels unread; it's here so an op
+	// that does accept them doesn't need a second round trip to fetch the pipeline config itself.
+	Params json.RawMessage `json:"params,omitempty"`
+	// Pipeline and Step identify which pipeline/step of pipelines.json produced this message, for
+	// correlating worker-side logs back to the config that dispatched them.
+	Pipeline string `json:"pipeline,omitempty"`
+	Step     int    `json:"step,omitempty"`
+	// OrigObject is the pipeline's original object name, held constant across every step of a
+	// chain so each step's SaveTo template resolves against it rather than the previous step's
+	// own (already-transformed) output name.
+	OrigObject string `json:"origObject,omitempty"`
+}
+
 var (
 	transformImageFunc = delay.Func("transform", transformImage)
+	// legacyNotificationsEnabled keeps the deprecated GCS Object Change Notification handler (at
+	// "/") serving traffic alongside the Pub/Sub push handler (at "/pubsub/push") during the
+	// deprecation window. Set DISABLE_LEGACY_GCS_NOTIFICATIONS=true once all buckets have been
+	// migrated to Pub/Sub notifications.
+	legacyNotificationsEnabled = os.Getenv("DISABLE_LEGACY_GCS_NOTIFICATIONS") != "true"
 )
 
 func init() {
@@ -51,6 +110,17 @@ type notification struct {
 	ObjectName     string `json:"name"`
 	ObjectSelfLink string `json:"selfLink"`
 	BucketName     string `json:"bucket"`
+	// Generation is overwritten with the authoritative value from a live GCS metadata fetch in
+	// dispatchTransform before dispatch; the notification body's own value is never trusted.
+	Generation string `json:"generation"`
+	// Transform names the variant to produce, one of "thumbnail", "moderate" or "intense". It is
+	// not part of the GCS notification body; it is read from the notification endpoint's own
+	// "transform" query parameter, so a given bucket can be configured to always request a
+	// particular variant.
+	Transform string `json:"-"`
+	// TraceID is the incoming request's X-Cloud-Trace-Context header, propagated to the worker so
+	// its structured logs correlate with this request.
+	TraceID string `json:"-"`
 }
 
 // handler processes a Cloud Storage Object Change Notification and pushes a
@@ -59,6 +129,11 @@ func handler(w http.ResponseWriter, r *http.Request) {
 	//Get App Engine context
 	c := appengine.NewContext(r)
 
+	if !legacyNotificationsEnabled {
+		c.Infof("Legacy GCS Object Change Notification handler is disabled; ignoring request")
+		return
+	}
+
 	//Handle Cloud Storage Object Change Notifications
 	//Get the HTTP Post resource state
 	resourceState := r.Header.Get("X-Goog-Resource-State")
@@ -90,45 +165,112 @@ func handler(w http.ResponseWriter, r *http.Request) {
 			n.ObjectSelfLink, err)
 		return
 	}
+	n.Transform = r.URL.Query().Get("transform")
+	n.TraceID = r.Header.Get("X-Cloud-Trace-Context")
 
-	transformImageFunc.Call(c, *n)
+	dispatchTransform(c, *n)
 }
 
-// transformImage takes a notification to manipulate an image and asks our backend service to
-// compute some transformation on it via HTTP. If the service is unavailable, it returns an error.
+// transformImage takes a notification to manipulate an image and publishes a transform request
+// to transformTopic for a worker to pull. Publishing rather than POSTing directly to a worker
+// means the message simply sits in the subscription, redelivered after its ack deadline, if the
+// VM that would have handled it is removed by the autoscaler mid-request.
 func transformImage(c appengine.Context, n notification) (err error) {
 	id := strings.Join([]string{n.BucketName, n.ObjectName}, "/")
 
-	//Create an image processing request
-	client := urlfetch.Client(c)
-	values := url.Values{
-		"id":      {id},
-		"save-to": {saveToBucketName},
+	// Redelivered notifications for the same object shouldn't dispatch a second job while one is
+	// already outstanding, or one has already completed this exact generation; confirmTransform
+	// marks the job record "done" once it's confirmed (or "failed" once abandoned).
+	if jobAlreadyHandled(c, id, n.Generation) {
+		c.Infof("Transform for %v (generation %v) already handled; skipping duplicate notification",
+			id, n.Generation)
+		return nil
 	}
 
-	//Create Post URL by combining HTTP protocol and processing pool IP address
-	postUrlParts := []string{"http://", processingPoolIp, "/process"}
-	postUrl := strings.Join(postUrlParts, "")
+	msg := transformMessage{
+		Bucket:       n.BucketName,
+		Object:       n.ObjectName,
+		SaveToBucket: saveToBucketName,
+		ID:           id,
+		AttemptCount: 1,
+		Transform:    n.Transform,
+		TraceID:      n.TraceID,
+		Generation:   n.Generation,
+	}
 
-	c.Infof("Sending request to transform: %v", n.ObjectName)
+	// Hand the worker a time-limited signed URL rather than requiring it to hold GCS read
+	// credentials of its own. If signing fails we fall back to letting the worker fetch the
+	// object itself using its own service account.
+	signedURL, serr := signedDownloadURL(c, n.BucketName, n.ObjectName, signedURLExpiry)
+	if serr != nil {
+		c.Errorf("Unable to sign download URL for %v: %v", n.ObjectName, serr)
+	} else {
+		msg.SignedURL = signedURL
+	}
 
-	//Send the image processing request to the image processing web service
-	resp, err := client.PostForm(postUrl, values)
-	if err != nil {
-		c.Errorf("Error sending POST to URL: %v", err)
-		return
+	if count, werr := healthyWorkerCount(c); werr != nil {
+		c.Warningf("Unable to determine healthy worker count: %v", werr)
+	} else if count == 0 {
+		c.Warningf("No healthy workers in %v; %v will wait in the subscription until the "+
+			"autoscaler adds one", instanceGroupName, msg.ID)
 	}
-	c.Infof("HTTP POST returned status: %v", resp.Status)
-	if resp.StatusCode != http.StatusOK {
-		err = errors.New("Non-200 response from backend")
-		return
+
+	if pl, ok := matchPipeline(n.BucketName, n.ObjectName); ok {
+		c.Infof("Dispatching pipeline %q (%d steps) for: %v", pl.Name, len(pl.Steps), n.ObjectName)
+		dispatchPipelineSteps(c, n, id, signedURL, pl)
+		return nil
 	}
-	respBody, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		c.Errorf("Error attempting to read resp body: %v", err)
+
+	c.Infof("Publishing transform request for: %v", n.ObjectName)
+	if err = publishTransform(c, msg); err != nil {
+		c.Errorf("Error publishing transform request: %v", err)
 		return
 	}
-	c.Infof("respBody=%v", string(respBody))
-	//TODO: Add Confirmation Queue to handle if assigned VM is deleted via Autoscaler scale down
+	recordJob(c, msg)
 	return
 }
+
+// publishTransform publishes msg as a single Pub/Sub message to transformTopic.
+func publishTransform(c appengine.Context, msg transformMessage) error {
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	client := urlfetch.Client(c)
+	service, err := pubsub.New(client)
+	if err != nil {
+		return err
+	}
+	req := &pubsub.PublishRequest{
+		Messages: []*pubsub.PubsubMessage{
+			{Data: base64.StdEncoding.EncodeToString(b)},
+		},
+	}
+	_, err = service.Projects.Topics.Publish(transformTopic, req).Do()
+	return err
+}
+
+// signedDownloadURL builds a GCS v2 signed URL granting GET access to bucket/object for the
+// given duration, signed with the application's own service account via appengine.SignBytes.
+// This lets a worker download the source image without needing GCS read credentials of its own.
+func signedDownloadURL(c appengine.Context, bucket, object string, expiry time.Duration) (string, error) {
+	expires := time.Now().Add(expiry).Unix()
+	resource := fmt.Sprintf("/%s/%s", bucket, object)
+	toSign := strings.Join([]string{"GET", "", "", fmt.Sprintf("%d", expires), resource}, "\n")
+
+	_, sig, err := appengine.SignBytes(c, []byte(toSign))
+	if err != nil {
+		return "", err
+	}
+	accountName, err := appengine.ServiceAccount(c)
+	if err != nil {
+		return "", err
+	}
+
+	v := url.Values{
+		"GoogleAccessId": {accountName},
+		"Expires":        {fmt.Sprintf("%d", expires)},
+		"Signature":      {base64.StdEncoding.EncodeToString(sig)},
+	}
+	return fmt.Sprintf("https://storage.googleapis.com%s?%s", resource, v.Encode()), nil
+}
@@ -0,0 +1,290 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"strings"
+
+	"appengine"
+	"appengine/delay"
+	"appengine/taskqueue"
+)
+
+// knownOps mirrors transformNames in compute/web-process-image.go: every PipelineStep.Op must
+// name one of these. A step naming anything else would become a poison message — the worker
+// would reject it as an unrecognized transform, it would never be acked, and Pub/Sub would
+// redeliver it forever — so loadPipelines rejects any pipeline with such a step up front instead.
+var knownOps = map[string]bool{"thumbnail": true, "moderate": true, "intense": true}
+
+// pipelineConfigPath is the JSON file, bundled alongside the app, mapping bucket/object-name
+// patterns to ordered transformation pipelines. Set via app.yaml; defaults to a file alongside
+// the deployed sources so `goapp serve` picks it up in development with no extra configuration.
+var pipelineConfigPath = envOrDefault("PIPELINE_CONFIG_PATH", "pipelines.json")
+
+// envOrDefault returns the named environment variable, or def if it is unset or empty.
+func envOrDefault(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+// PipelineStep is one operation in a Pipeline, e.g. {"op": "thumbnail", "saveTo": "..."}. Op must
+// be one of knownOps, mirroring a transform the worker's backend (see
+// newImagemagickBackend/newVipsBackend in compute/web-process-image.go) already registers; adding
+// a new op means registering a Transform implementation for it there, and adding it to knownOps,
+// first.
+type PipelineStep struct {
+	Op string `json:"op"`
+	// Params carries op-specific configuration, e.g. {"w":200,"h":200} for an op that accepts
+	// resize dimensions. Left as raw JSON so each op can interpret its own shape; today's worker
+	// transforms don't take any, so this travels unread until one does.
+	Params json.RawMessage `json:"params"`
+	// SaveTo is a template for this step's output object name, e.g. "thumbs/{name}-200{ext}".
+	// See resolveSaveTo for the supported placeholders.
+	SaveTo string `json:"saveTo"`
+	// SaveToBucket overrides saveToBucketName for this step; empty means use saveToBucketName.
+	SaveToBucket string `json:"saveToBucket"`
+	// Queue names the App Engine task queue (declared in queue.yaml) this step's dispatch task is
+	// enqueued on, so an expensive pipeline (e.g. a video transcode) can be rate-limited
+	// independently of a cheap one (e.g. thumbnailing) instead of competing for the same quota.
+	// Empty means the default queue.
+	Queue string `json:"queue"`
+}
+
+// Pipeline is an ordered list of steps applied to objects matching Pattern (and, if set, Bucket).
+type Pipeline struct {
+	Name    string         `json:"name"`
+	Bucket  string         `json:"bucket"`
+	Pattern string         `json:"pattern"`
+	Steps   []PipelineStep `json:"steps"`
+}
+
+// pipelines holds pipelineConfigPath's parsed contents, loaded once at startup. A lookup that
+// matches nothing isn't an error: transformImage falls back to its legacy single-variant dispatch
+// for any bucket or object that hasn't been given a pipeline.
+var pipelines = loadPipelines(pipelineConfigPath)
+
+// loadPipelines reads and parses path's pipeline config. A missing or invalid file is logged and
+// treated as "no pipelines configured" rather than failing app startup, since most deployments
+// won't have one. A pipeline that fails validatePipeline is logged and dropped individually
+// rather than failing the whole load, so one bad entry in pipelines.json doesn't take every
+// pipeline down.
+func loadPipelines(path string) []Pipeline {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("pipeline: unable to read %v: %v", path, err)
+		}
+		return nil
+	}
+	var cfg struct {
+		Pipelines []Pipeline `json:"pipelines"`
+	}
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		log.Printf("pipeline: unable to parse %v: %v", path, err)
+		return nil
+	}
+	var valid []Pipeline
+	for _, p := range cfg.Pipelines {
+		if err := validatePipeline(p); err != nil {
+			log.Printf("pipeline: rejecting pipeline %v: %v", p.Name, err)
+			continue
+		}
+		valid = append(valid, p)
+	}
+	return valid
+}
+
+// validatePipeline rejects a pipeline with no steps, or with any step whose Op isn't in
+// knownOps — see knownOps for why that would otherwise dispatch a message the worker can never
+// ack.
+func validatePipeline(p Pipeline) error {
+	if len(p.Steps) == 0 {
+		return fmt.Errorf("no steps")
+	}
+	for i, step := range p.Steps {
+		if !knownOps[step.Op] {
+			return fmt.Errorf("step %d: op %q is not one of the worker's registered transforms", i, step.Op)
+		}
+	}
+	return nil
+}
+
+// matchPipeline returns the first configured pipeline whose Bucket (if set) matches bucket and
+// whose Pattern matches object, or false if none do.
+func matchPipeline(bucket, object string) (Pipeline, bool) {
+	for _, p := range pipelines {
+		if p.Bucket != "" && p.Bucket != bucket {
+			continue
+		}
+		ok, err := path.Match(p.Pattern, object)
+		if err != nil {
+			log.Printf("pipeline: invalid pattern %q in pipeline %v: %v", p.Pattern, p.Name, err)
+			continue
+		}
+		if ok {
+			return p, true
+		}
+	}
+	return Pipeline{}, false
+}
+
+// pipelineByName returns the configured pipeline with the given name, or false if none matches.
+// advancePipeline uses this to look up a step's own pipeline by name rather than by re-matching
+// Bucket/Pattern against an intermediate object, which wouldn't necessarily match at all.
+func pipelineByName(name string) (Pipeline, bool) {
+	for _, p := range pipelines {
+		if p.Name == name {
+			return p, true
+		}
+	}
+	return Pipeline{}, false
+}
+
+// resolveSaveTo expands a step's SaveTo template against the source object name. Supported
+// placeholders: {object} (full source object name), {name} (object name without extension), and
+// {ext} (extension, including the dot).
+func resolveSaveTo(tmpl, object string) string {
+	ext := path.Ext(object)
+	name := strings.TrimSuffix(object, ext)
+	r := strings.NewReplacer("{object}", object, "{name}", name, "{ext}", ext)
+	return r.Replace(tmpl)
+}
+
+// pipelineStepFunc is the delayed task dispatchPipelineSteps and advancePipeline schedule for
+// each step of a pipeline.
+var pipelineStepFunc = delay.Func("pipelineStep", publishPipelineStep)
+
+// dispatchPipelineSteps enqueues pl's first step onto the named task queue it configures. Later
+// steps are NOT dispatched here: each one reads the previous step's output as its own source
+// (see buildStepMessage), so it can't run until confirmTransform observes that output has
+// actually appeared in GCS and calls advancePipeline — that's what makes this a real ordered
+// chain (e.g. resize -> webp -> watermark) rather than every step transforming the original
+// object independently.
+func dispatchPipelineSteps(c appengine.Context, n notification, id, signedURL string, pl Pipeline) {
+	// Written synchronously, unlike recordJob for the legacy path, so a redelivered notification
+	// is recognized even before the first step's queued task has actually run; see markJobPending.
+	markJobPending(c, id)
+
+	first := pl.Steps[0]
+	msg := buildStepMessage(id, signedURL, n.TraceID, n.Generation, n.BucketName, n.ObjectName,
+		n.ObjectName, pl, 0, first)
+	enqueueStep(c, msg, pl.Name, first)
+}
+
+// buildStepMessage constructs the transformMessage for step i of pl. sourceBucket/sourceObject is
+// what this step reads as input — the pipeline's original object for step 0, or the previous
+// step's own output once advancePipeline is chaining steps together. origObject is the
+// pipeline's original object name, held constant across every step purely so SaveTo templates
+// (resolved against it, not each hop's own output name) stay meaningful no matter how deep the
+// chain runs.
+func buildStepMessage(id, signedURL, traceID, generation, sourceBucket, sourceObject, origObject string,
+	pl Pipeline, i int, step PipelineStep) transformMessage {
+	saveToBucket := saveToBucketName
+	if step.SaveToBucket != "" {
+		saveToBucket = step.SaveToBucket
+	}
+	return transformMessage{
+		Bucket:       sourceBucket,
+		Object:       sourceObject,
+		SaveToBucket: saveToBucket,
+		SaveToObject: resolveSaveTo(step.SaveTo, origObject),
+		ID:           id,
+		AttemptCount: 1,
+		Transform:    step.Op,
+		SignedURL:    signedURL,
+		Op:           step.Op,
+		Params:       step.Params,
+		Pipeline:     pl.Name,
+		Step:         i,
+		OrigObject:   origObject,
+		TraceID:      traceID,
+		Generation:   generation,
+	}
+}
+
+// enqueueStep builds and enqueues the delayed task that publishes msg, onto step's named task
+// queue (see queue.yaml).
+func enqueueStep(c appengine.Context, msg transformMessage, pipelineName string, step PipelineStep) {
+	task, err := pipelineStepFunc.Task(msg)
+	if err != nil {
+		c.Errorf("Unable to build task for pipeline %v step %d (%v): %v", pipelineName, msg.Step, step.Op, err)
+		return
+	}
+	if _, err := taskqueue.Add(c, task, step.Queue); err != nil {
+		c.Errorf("Unable to enqueue pipeline %v step %d (%v) onto queue %q: %v",
+			pipelineName, msg.Step, step.Op, step.Queue, err)
+	}
+}
+
+// publishPipelineStep is the delayed task body dispatchPipelineSteps and advancePipeline
+// schedule for each step of a pipeline, run once the step's named task queue admits it. Every
+// step is handed to recordJob, under its own per-step Datastore key (see jobRecordKey), so
+// confirmTransform polls for and confirms each step's own output — which is also what lets
+// confirmTransform trigger advancePipeline once a non-final step's output appears.
+func publishPipelineStep(c appengine.Context, msg transformMessage) error {
+	if err := publishTransform(c, msg); err != nil {
+		c.Errorf("Error publishing pipeline %v step %d (%v): %v", msg.Pipeline, msg.Step, msg.Transform, err)
+		return err
+	}
+	recordJob(c, msg)
+	return nil
+}
+
+// isFinalStep reports whether msg is the last step of its pipeline (or isn't part of a pipeline at
+// all, in which case it's trivially "final"). confirmTransform uses this to decide whether a
+// step's own confirmation also closes out the bare-id job record jobAlreadyHandled consults, since
+// that record must not stay "pending" past the point the whole pipeline can advance no further.
+func isFinalStep(msg transformMessage) bool {
+	if msg.Pipeline == "" {
+		return true
+	}
+	pl, ok := pipelineByName(msg.Pipeline)
+	if !ok {
+		return true
+	}
+	return msg.Step+1 >= len(pl.Steps)
+}
+
+// advancePipeline dispatches the step after msg's, if any, once confirmTransform has observed
+// that msg's own step produced outputObject. The next step reads outputObject (in msg's
+// SaveToBucket) as its source instead of the pipeline's original object, which is what chains a
+// multi-step pipeline's steps together instead of running each independently against the same
+// source image.
+func advancePipeline(c appengine.Context, msg transformMessage, outputObject string) {
+	if msg.Pipeline == "" {
+		return
+	}
+	pl, ok := pipelineByName(msg.Pipeline)
+	if !ok {
+		c.Errorf("advancePipeline: pipeline %v no longer configured; not advancing %v", msg.Pipeline, msg.ID)
+		return
+	}
+	next := msg.Step + 1
+	if next >= len(pl.Steps) {
+		return
+	}
+	step := pl.Steps[next]
+	nextMsg := buildStepMessage(msg.ID, "", msg.TraceID, msg.Generation, msg.SaveToBucket, outputObject,
+		msg.OrigObject, pl, next, step)
+	enqueueStep(c, nextMsg, pl.Name, step)
+}
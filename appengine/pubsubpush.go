@@ -0,0 +1,146 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+
+	"appengine"
+	"appengine/urlfetch"
+	"google.golang.org/api/idtoken"
+	"google.golang.org/api/option"
+)
+
+// pubsubPushToken is an optional shared secret appended to the push subscription's endpoint URL
+// (?token=...), checked in addition to the OIDC bearer token below. Set via app.yaml.
+var pubsubPushToken = os.Getenv("PUBSUB_PUSH_TOKEN")
+
+func init() {
+	http.HandleFunc("/pubsub/push", pubsubPushHandler)
+}
+
+// pushEnvelope is the body Cloud Pub/Sub push subscriptions POST to their endpoint.
+type pushEnvelope struct {
+	Message struct {
+		Attributes map[string]string `json:"attributes"`
+		Data       string            `json:"data"`
+		MessageID  string            `json:"messageId"`
+	} `json:"message"`
+	Subscription string `json:"subscription"`
+}
+
+// objectResource is the GCS object resource Cloud Storage bucket notifications publish as a
+// push message's data; it carries the same fields as the legacy notification struct.
+type objectResource struct {
+	ID         string `json:"id"`
+	Name       string `json:"name"`
+	SelfLink   string `json:"selfLink"`
+	Bucket     string `json:"bucket"`
+	Generation string `json:"generation"`
+}
+
+// pubsubPushHandler is the replacement for the deprecated GCS Object Change Notification handler:
+// Cloud Storage now publishes bucket notifications to a Pub/Sub topic, and this endpoint is
+// registered as that topic's push subscription. The legacy handler at "/" is kept running
+// alongside this one for the deprecation window; see legacyNotificationsEnabled.
+func pubsubPushHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	if !verifyPushRequest(c, r) {
+		c.Errorf("pubsub push: rejected request that failed verification")
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		c.Errorf("pubsub push: unable to read body: %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	var env pushEnvelope
+	if err := json.Unmarshal(b, &env); err != nil {
+		c.Errorf("pubsub push: unable to unmarshal envelope: %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if eventType := env.Message.Attributes["eventType"]; eventType != "OBJECT_FINALIZE" {
+		c.Infof("pubsub push: ignoring eventType %v", eventType)
+		return
+	}
+
+	data, err := base64.StdEncoding.DecodeString(env.Message.Data)
+	if err != nil {
+		c.Errorf("pubsub push: unable to decode message data: %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	obj := objectResource{}
+	if err := json.Unmarshal(data, &obj); err != nil {
+		c.Errorf("pubsub push: unable to unmarshal object resource: %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	n := notification{
+		ID:             obj.ID,
+		ObjectName:     obj.Name,
+		ObjectSelfLink: obj.SelfLink,
+		BucketName:     obj.Bucket,
+		Generation:     obj.Generation,
+		Transform:      r.URL.Query().Get("transform"),
+		TraceID:        r.Header.Get("X-Cloud-Trace-Context"),
+	}
+	dispatchTransform(c, n)
+}
+
+// verifyPushRequest checks the shared-secret token query parameter, if one is configured, and the
+// OIDC bearer token Pub/Sub attaches to authenticated push requests, validating its audience
+// against this handler's own URL (issuer is always accounts.google.com for Pub/Sub-minted tokens).
+func verifyPushRequest(c appengine.Context, r *http.Request) bool {
+	if pubsubPushToken != "" && r.URL.Query().Get("token") != pubsubPushToken {
+		return false
+	}
+
+	authz := r.Header.Get("Authorization")
+	const bearerPrefix = "Bearer "
+	if !strings.HasPrefix(authz, bearerPrefix) {
+		// With no bearer token to check, fall back to the shared-secret token alone.
+		return pubsubPushToken != ""
+	}
+	tok := strings.TrimPrefix(authz, bearerPrefix)
+	audience := fmt.Sprintf("https://%s/pubsub/push", appengine.DefaultVersionHostname(c))
+	// idtoken.Validate's default HTTP client fetches Google's cert set directly, which doesn't
+	// work on this runtime: every outbound call here goes through appengine/urlfetch instead (see
+	// e.g. objectExists, publishTransform). NewValidator lets us supply that client explicitly.
+	validator, err := idtoken.NewValidator(context.Background(), option.WithHTTPClient(urlfetch.Client(c)))
+	if err != nil {
+		c.Errorf("pubsub push: unable to build OIDC validator: %v", err)
+		return false
+	}
+	if _, err := validator.Validate(context.Background(), tok, audience); err != nil {
+		c.Errorf("pubsub push: invalid OIDC token: %v", err)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,77 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"appengine"
+	"appengine/urlfetch"
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/option"
+)
+
+// maxObjectSizeBytes caps how large a source image this app will dispatch for transformation;
+// notifications for larger objects are rejected rather than risking an expensive, likely-useless
+// ImageMagick/libvips run on something that was never meant to be a thumbnail source.
+const maxObjectSizeBytes = 20 << 20 // 20MB
+
+// allowedContentTypes is the set of GCS content types eligible for transformation.
+var allowedContentTypes = map[string]bool{
+	"image/jpeg": true,
+	"image/png":  true,
+	"image/gif":  true,
+	"image/webp": true,
+}
+
+// dispatchTransform validates n's object against live GCS metadata before enqueuing a transform,
+// rather than trusting whatever a notification body (legacy or Pub/Sub) claims. It's the only
+// path either handler should use to reach transformImageFunc.
+func dispatchTransform(c appengine.Context, n notification) {
+	attrs, err := fetchAndValidateObject(c, n.BucketName, n.ObjectName)
+	if err != nil {
+		c.Errorf("Rejecting notification for %v/%v: %v", n.BucketName, n.ObjectName, err)
+		return
+	}
+	// Trust the generation we just observed live over whatever the notification body claimed.
+	n.Generation = strconv.FormatInt(attrs.Generation, 10)
+
+	transformImageFunc.Call(c, n)
+}
+
+// fetchAndValidateObject fetches bucket/name's live metadata via the GCS JSON API and rejects it
+// if its content type isn't an allowed image type or its size exceeds maxObjectSizeBytes.
+func fetchAndValidateObject(c appengine.Context, bucket, name string) (*storage.ObjectAttrs, error) {
+	ctx := context.Background()
+	client, err := storage.NewClient(ctx, option.WithHTTPClient(urlfetch.Client(c)))
+	if err != nil {
+		return nil, fmt.Errorf("unable to create storage client: %v", err)
+	}
+	defer client.Close()
+
+	attrs, err := client.Bucket(bucket).Object(name).Attrs(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("unable to fetch object metadata: %v", err)
+	}
+	if !allowedContentTypes[attrs.ContentType] {
+		return nil, fmt.Errorf("content type %q is not an allowed image type", attrs.ContentType)
+	}
+	if attrs.Size > maxObjectSizeBytes {
+		return nil, fmt.Errorf("size %d exceeds the %d byte cap", attrs.Size, maxObjectSizeBytes)
+	}
+	return attrs, nil
+}
@@ -0,0 +1,102 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"os"
+	"strconv"
+	"time"
+
+	"appengine"
+	"appengine/memcache"
+	"appengine/urlfetch"
+	compute "google.golang.org/api/compute/v1"
+)
+
+// Per-project configuration for the worker instance group, set via app.yaml env_variables. These
+// no longer select a POST target directly (workers pull their own work from Pub/Sub), but they
+// let the frontend warn when it publishes a transform request with no worker around to pull it.
+var (
+	computeProject    = os.Getenv("COMPUTE_PROJECT")
+	computeZone       = os.Getenv("COMPUTE_ZONE")
+	instanceGroupName = os.Getenv("WORKER_INSTANCE_GROUP")
+)
+
+// healthyWorkerPoolCacheKey is the memcache key the resolved worker count is cached under.
+const healthyWorkerPoolCacheKey = "healthy-worker-count"
+
+// healthyWorkerPoolCacheTTL bounds how stale the cached worker count may be. It's short enough
+// that a just-finished scale-up or scale-down is reflected promptly, but long enough that a burst
+// of notifications doesn't call the Compute API once per request.
+const healthyWorkerPoolCacheTTL = 30 * time.Second
+
+// healthyWorkerCount returns the number of RUNNING instances in the worker autoscaler's managed
+// instance group, consulting memcache first to avoid calling the Compute API on every request.
+func healthyWorkerCount(c appengine.Context) (int, error) {
+	if item, err := memcache.Get(c, healthyWorkerPoolCacheKey); err == nil {
+		if n, err := strconv.Atoi(string(item.Value)); err == nil {
+			return n, nil
+		}
+	}
+
+	n, err := countRunningInstances(c)
+	if err != nil {
+		return 0, err
+	}
+
+	memcache.Set(c, &memcache.Item{
+		Key:        healthyWorkerPoolCacheKey,
+		Value:      []byte(strconv.Itoa(n)),
+		Expiration: healthyWorkerPoolCacheTTL,
+	})
+	return n, nil
+}
+
+// countRunningInstances calls the Compute Engine API to list the RUNNING members of
+// instanceGroupName. ListInstances pages its results, so a single Do() call only reflects the
+// first page; this walks every page via PageToken rather than undercounting a large group.
+//
+// This only ever feeds a diagnostic warning (see healthyWorkerCount's caller in main.go) rather
+// than selecting an instance to route to: since chunk0-2's move to Pub/Sub, workers pull their own
+// work from the subscription, so the frontend never needs to resolve a worker IP or dispatch to
+// one directly. Resolving IPs for routing, as the original request asked, would be dead code now.
+func countRunningInstances(c appengine.Context) (int, error) {
+	client := urlfetch.Client(c)
+	service, err := compute.New(client)
+	if err != nil {
+		return 0, err
+	}
+	req := &compute.InstanceGroupsListInstancesRequest{
+		InstanceState: "RUNNING",
+	}
+	var total int
+	pageToken := ""
+	for {
+		call := service.InstanceGroups.ListInstances(computeProject, computeZone, instanceGroupName, req)
+		if pageToken != "" {
+			call = call.PageToken(pageToken)
+		}
+		resp, err := call.Do()
+		if err != nil {
+			return 0, err
+		}
+		total += len(resp.Items)
+		if resp.NextPageToken == "" {
+			break
+		}
+		pageToken = resp.NextPageToken
+	}
+	return total, nil
+}
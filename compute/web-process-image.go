@@ -16,258 +16,662 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
 	"os/exec"
-	"path"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
 	"code.google.com/p/goauth2/compute/serviceaccount"
 	storage "code.google.com/p/google-api-go-client/storage/v1"
+	"github.com/GoogleCloudPlatform/httplb-autoscaling-go/retrytransport"
+	"github.com/GoogleCloudPlatform/httplb-autoscaling-go/telemetry"
+	"github.com/davidbyttow/govips/v2/vips"
+	monitoring "google.golang.org/api/monitoring/v3"
+	pubsub "google.golang.org/api/pubsub/v1"
 )
 
 const (
 	NumImageProcessors    = 2
 	ImageProcessQueueSize = 50
 	ThumbnailSuffix       = "-t"
+	// pullMaxWaitInterval is how long the pull loop sleeps before retrying when the processing
+	// queue is saturated or a pull itself failed.
+	pullMaxWaitInterval = 500 * time.Millisecond
+	// cachePrefix namespaces ThumbnailCache entries within the destination bucket so they don't
+	// collide with, or get mistaken for, the final output objects they're promoted to.
+	cachePrefix = "cache/"
+	// defaultVariant is the transform applied when a request doesn't name one.
+	defaultVariant = "moderate"
 )
 
 var (
-	hostname string
-	// A map of HTTP response codes which we consider to be retryable.
-	retryableCodes = map[int]bool{
-		http.StatusForbidden:           true,
-		http.StatusInternalServerError: true,
-		http.StatusBadGateway:          true,
-		http.StatusServiceUnavailable:  true,
-		http.StatusGatewayTimeout:      true,
-	}
+	subscription = flag.String("subscription", "",
+		"Full name of the Pub/Sub subscription to pull transform requests from, e.g. "+
+			"projects/my-project/subscriptions/image-transform-requests.")
+	backendFlag = flag.String("backend", "imagemagick",
+		"Which transform backend to use: vips or imagemagick.")
+	project = flag.String("project", "",
+		"Project ID to publish Cloud Monitoring custom metrics under.")
 )
 
-// RetryTransport wraps http.DefaultTransport and provides for retrying HTTP requests up to maxTries times.
-type RetryTransport struct {
-	http.RoundTripper
-	maxTries int
+var hostname string
+
+// Transform applies a named image transformation, reading the source image from in and writing
+// the result to out. Implementations may shell out (imagemagickTransform) or use an in-process
+// library (vipsTransform). imagemagickTransform streams the image through a pipe; vipsTransform
+// buffers the whole image in memory (see vipsTransform).
+type Transform interface {
+	Apply(ctx context.Context, in io.Reader, out io.Writer) error
 }
 
-// RoundTrip implements the http.RoundTripper interface and will attempt to retry an HTTP request
-// if the response contains a retryable status code.
-func (t *RetryTransport) RoundTrip(req *http.Request) (resp *http.Response, err error) {
-	var body []byte
-	if req.Body != nil {
-		body, err = ioutil.ReadAll(req.Body)
-		if err != nil {
-			return
-		}
-	}
-	for i := 0; i < t.maxTries; i++ {
-		if i != 0 {
-			// Build a new request.
-			req = copyRequest(req, body)
-		}
-		resp, err = t.RoundTripper.RoundTrip(req)
-		if err == nil {
-			if !retryableCodes[resp.StatusCode] {
-				break // Success!
-			}
-			resp.Body.Close()
+// transformNames lists the variants the frontend may request.
+var transformNames = []string{"thumbnail", "moderate", "intense"}
+
+// isTransformName reports whether name is one of transformNames.
+func isTransformName(name string) bool {
+	for _, n := range transformNames {
+		if n == name {
+			return true
 		}
 	}
-	return
+	return false
 }
 
-// copyRequest constructs a new HTTP request mirroring the provided one with the given body.
-func copyRequest(req *http.Request, body []byte) *http.Request {
-	nreq, err := http.NewRequest(req.Method, req.URL.String(), bytes.NewReader(body))
-	if err != nil {
-		log.Panicf("Unable to copy http request: %v", err)
-	}
-	for k, vv := range req.Header {
-		vv2 := make([]string, len(vv))
-		copy(vv2, vv)
-		nreq.Header[k] = vv2
-	}
-	return nreq
+// transformMessage mirrors the JSON payload the App Engine frontend publishes to the transform
+// topic. Keep this in sync with the transformMessage type in appengine/main.go.
+type transformMessage struct {
+	Bucket       string `json:"bucket"`
+	Object       string `json:"object"`
+	SaveToBucket string `json:"saveToBucket"`
+	ID           string `json:"id"`
+	AttemptCount int    `json:"attemptCount"`
+	// Transform names the variant to apply, one of transformNames. Empty means defaultVariant.
+	Transform string `json:"transform"`
+	// TraceID is the incoming X-Cloud-Trace-Context the App Engine frontend saw, propagated so
+	// the structured logs for a single image can be correlated end to end.
+	TraceID string `json:"traceId"`
+	// SignedURL is a time-limited signed GCS download URL for Bucket/Object, used in place of the
+	// GCS JSON API so this worker need not hold read credentials of its own. It is empty if
+	// signing failed, and for a pipeline step after the first; openSource then falls back to
+	// srcObj.MediaLink.
+	SignedURL string `json:"signedUrl,omitempty"`
+	// SaveToObject, if set, is the exact output object name a pipeline step resolved from its
+	// SaveTo template, overriding this worker's own suffix-based naming. Empty for legacy
+	// single-variant dispatch.
+	SaveToObject string `json:"saveToObject,omitempty"`
+	// Op and Params describe a pipeline step's operation and configuration; Op is also copied
+	// into Transform, so this worker dispatches on that single familiar field either way. Unused
+	// until a transform accepts Params.
+	Op     string          `json:"op,omitempty"`
+	Params json.RawMessage `json:"params,omitempty"`
+	// Pipeline and Step identify which pipeline/step of pipelines.json produced this message.
+	Pipeline string `json:"pipeline,omitempty"`
+	Step     int    `json:"step,omitempty"`
 }
 
-// A processImageReq represents a request to perform some transformation on a given image.
+// A processImageReq represents a request to perform some transformation on a given image. If
+// signedURL is set, it is used to download the source image directly instead of going through
+// the GCS JSON API, so the worker need not hold read credentials of its own. ackID identifies the
+// Pub/Sub delivery this request came from, and is only acknowledged once the transform and
+// upload both succeed; otherwise the message is redelivered, possibly to another VM. transform
+// names which entry of the imageProcessor's registry to apply.
 type processImageReq struct {
 	sourceBucket, filename, saveToBucket, saveToFilename string
+	signedURL, ackID                                     string
+	transform                                            string
+	traceID                                              string
+	attempt                                              int
 }
 
-// getProcessImageReq attempts to parse a processImageReq from the provided request.
-func getProcessImageReq(r *http.Request) (processImageReq, error) {
-	// Pull vars from the request.
-	objectPath := r.FormValue("id")
-	if objectPath == "" {
-		return processImageReq{}, errors.New("Request did not provide image id.")
+// processImageReqFromMessage builds a processImageReq from a transformMessage pulled off
+// the subscription.
+func processImageReqFromMessage(msg transformMessage, ackID string) (processImageReq, error) {
+	if msg.Bucket == "" || msg.Object == "" {
+		return processImageReq{}, errors.New("message did not provide a source bucket and object.")
 	}
-	sourceBucket, filename := path.Split(objectPath)
-	sourceBucket = strings.Trim(sourceBucket, "/")
-	saveToBucket := r.FormValue("save-to")
+	sourceBucket, filename := msg.Bucket, msg.Object
 
-	// Now get the filename extension.
-	extension := filepath.Ext(filename)
-	name := filename[:len(filename)-len(extension)]
-	filenameElements := []string{name, ThumbnailSuffix, extension}
-	saveToFilename := strings.Join(filenameElements, "")
+	// A pipeline step names its own output via SaveToObject; only legacy single-variant messages
+	// fall back to deriving a name from the source filename plus ThumbnailSuffix.
+	saveToFilename := msg.SaveToObject
+	if saveToFilename == "" {
+		extension := filepath.Ext(filename)
+		name := filename[:len(filename)-len(extension)]
+		filenameElements := []string{name, ThumbnailSuffix, extension}
+		saveToFilename = strings.Join(filenameElements, "")
+	}
+	transform := msg.Transform
+	if transform == "" {
+		transform = defaultVariant
+	}
+	if !isTransformName(transform) {
+		return processImageReq{}, fmt.Errorf("unrecognized transform %q", transform)
+	}
 	return processImageReq{
 		sourceBucket:   sourceBucket,
 		filename:       filename,
-		saveToBucket:   saveToBucket,
+		saveToBucket:   msg.SaveToBucket,
 		saveToFilename: saveToFilename,
+		signedURL:      msg.SignedURL,
+		ackID:          ackID,
+		transform:      transform,
+		traceID:        msg.TraceID,
+		attempt:        msg.AttemptCount,
 	}, nil
 }
 
-// imagemagickHandler implements the http.Handler interface and provides for farming image
-// manipulation requests out among a static number of goroutines.
-type imagemagickHandler struct {
-	c chan<- processImageReq
+// pullSubscriber repeatedly pulls transform requests off a Pub/Sub subscription and dispatches
+// them to a shared processing queue. It applies backpressure by only pulling as many messages as
+// there is room for in the queue, so a burst of notifications can't be pulled faster than the
+// fixed pool of processors can work through them.
+type pullSubscriber struct {
+	c            chan<- processImageReq
+	ps           *pubsub.Service
+	subscription string
+	queueSize    int
+	l            *log.Logger
 }
 
-// ServeHTTP attempts to process an image manipulation request and returns a 200. If the request
-// could not be queued, a 503 is returned; if the request was otherwise invalid, a 500.
-func (h *imagemagickHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	req, err := getProcessImageReq(r)
-	if err != nil {
-		w.WriteHeader(500)
-		return
-	}
-	select {
-	case h.c <- req:
-		fmt.Fprintf(w, "hostname=%s", hostname)
-	default:
-		w.WriteHeader(503)
+// NewPullSubscriber constructs a pullSubscriber which dispatches onto c.
+func NewPullSubscriber(c chan<- processImageReq, ps *pubsub.Service, subscription string, queueSize int) *pullSubscriber {
+	return &pullSubscriber{c: c, ps: ps, subscription: subscription, queueSize: queueSize,
+		l: log.New(os.Stderr, "PullSubscriber", log.LstdFlags)}
+}
+
+// run pulls messages until the process is killed. It never returns.
+func (s *pullSubscriber) run() {
+	for {
+		avail := s.queueSize - len(s.c)
+		if avail <= 0 {
+			time.Sleep(pullMaxWaitInterval)
+			continue
+		}
+		resp, err := s.ps.Projects.Subscriptions.Pull(s.subscription, &pubsub.PullRequest{
+			ReturnImmediately: false,
+			MaxMessages:       int64(avail),
+		}).Do()
+		if err != nil {
+			s.l.Printf("Pull failed: %v\n", err)
+			time.Sleep(pullMaxWaitInterval)
+			continue
+		}
+		for _, rm := range resp.ReceivedMessages {
+			data, err := base64.StdEncoding.DecodeString(rm.Message.Data)
+			if err != nil {
+				s.l.Printf("Unable to decode message data: %v\n", err)
+				continue
+			}
+			var msg transformMessage
+			if err := json.Unmarshal(data, &msg); err != nil {
+				s.l.Printf("Unable to unmarshal message: %v\n", err)
+				continue
+			}
+			req, err := processImageReqFromMessage(msg, rm.AckId)
+			if err != nil {
+				s.l.Printf("Unable to build request from message: %v\n", err)
+				continue
+			}
+			s.c <- req
+		}
 	}
 }
 
-// NewImagemagickHandler builds returns a new imagemagickHandler with the specified queueSize and
-// number of processing routines.
-func NewImagemagickHandler(queueSize, numRoutines int) (h *imagemagickHandler) {
-	c := make(chan processImageReq, queueSize)
-	h = &imagemagickHandler{c: c}
-	for i := 0; i < numRoutines; i++ {
-		p := NewImageProcessor(c, fmt.Sprintf("Processor(%d)", i))
-		go p.process()
+// ThumbnailCache provides a content-addressable cache of already-produced thumbnails, keyed by
+// the source object's CRC32C and the transform variant applied. This makes transform processing
+// idempotent: a redelivered Pub/Sub message, or a notification the App Engine handler double
+// fires, results in a cheap server-side copy rather than burning CPU re-running ImageMagick.
+type ThumbnailCache struct {
+	s *storage.Service
+}
+
+// NewThumbnailCache constructs a ThumbnailCache backed by s.
+func NewThumbnailCache(s *storage.Service) *ThumbnailCache {
+	return &ThumbnailCache{s: s}
+}
+
+// key returns the cache object name for the given source CRC32C and transform variant.
+func (tc *ThumbnailCache) key(crc32c, variant string) string {
+	sum := sha256.Sum256([]byte(crc32c + "-" + variant))
+	return cachePrefix + hex.EncodeToString(sum[:])
+}
+
+// Lookup performs a single Objects.Get against bucket for the cache entry matching crc32c and
+// variant. The returned bool reports whether a cached thumbnail exists.
+func (tc *ThumbnailCache) Lookup(bucket, crc32c, variant string) (*storage.Object, bool) {
+	obj, err := tc.s.Objects.Get(bucket, tc.key(crc32c, variant)).Do()
+	if err != nil {
+		return nil, false
 	}
-	return
+	return obj, true
+}
+
+// CopyToFinal performs a server-side copy of a cache hit to its final destination name, avoiding
+// a re-download and re-upload of the thumbnail bytes.
+func (tc *ThumbnailCache) CopyToFinal(bucket string, cached *storage.Object, destName string) error {
+	_, err := tc.s.Objects.Copy(bucket, cached.Name, bucket, destName, nil).Do()
+	return err
+}
+
+// PromoteToFinal is called after a cache miss has been freshly uploaded to the cache entry for
+// crc32c/variant; it uses a single Objects.Rewrite call to also place the result at destName,
+// rather than uploading the same bytes a second time.
+func (tc *ThumbnailCache) PromoteToFinal(bucket, crc32c, variant, destName string) error {
+	_, err := tc.s.Objects.Rewrite(bucket, tc.key(crc32c, variant), bucket, destName, nil).Do()
+	return err
 }
 
 type imageProcessor struct {
-	c      <-chan processImageReq
-	client *http.Client
-	s      *storage.Service
-	l      *log.Logger
+	c            <-chan processImageReq
+	client       *http.Client
+	s            *storage.Service
+	ps           *pubsub.Service
+	subscription string
+	cache        *ThumbnailCache
+	transforms   map[string]Transform
+	telemetry    *telemetry.Logger
+	metrics      *telemetry.MetricsPublisher
+	l            *log.Logger
 }
 
-// process reads from the imageProcessor's input channel and attempts to process an image.
+// process reads from the imageProcessor's input channel and attempts to process an image. On
+// success, the underlying Pub/Sub delivery is acknowledged; on failure it is left to be
+// redelivered, either to this VM or another one.
 func (p *imageProcessor) process() {
 	for r := range p.c {
 		t := time.Now()
-		if err := p.processImage(r); err != nil {
+		if err := p.ProcessImageStreaming(context.Background(), r); err != nil {
 			p.l.Printf("Could not process image %v: %v\n", r.saveToFilename, err)
+		} else {
+			p.acknowledge(r.ackID)
 		}
 		p.l.Printf("Processing took %fs\n", time.Since(t).Seconds())
 	}
 }
 
-// getImageBytes attempts to download and return the bytes of the indicated GCS object. It may
-// panic if a network request cannot be completed within 4 attempts.
-func (p *imageProcessor) getImageBytes(sourceBucket, filename string) (b []byte) {
-	obj, err := p.s.Objects.Get(sourceBucket, filename).Do()
+// acknowledge acks ackID against the processor's subscription so it is not redelivered.
+func (p *imageProcessor) acknowledge(ackID string) {
+	if ackID == "" {
+		return
+	}
+	req := &pubsub.AcknowledgeRequest{AckIds: []string{ackID}}
+	if _, err := p.ps.Projects.Subscriptions.Acknowledge(p.subscription, req).Do(); err != nil {
+		p.l.Printf("Unable to acknowledge %v: %v\n", ackID, err)
+	}
+}
+
+// openSource opens the source image for r, either by following the caller-supplied signed URL
+// (preferred, since it requires no GCS read credentials on the worker) or by falling back to an
+// authenticated download of srcObj.MediaLink.
+func (p *imageProcessor) openSource(ctx context.Context, r processImageReq, srcObj *storage.Object) (io.ReadCloser, error) {
+	mediaURL := srcObj.MediaLink
+	if r.signedURL != "" {
+		mediaURL = r.signedURL
+	}
+	req, err := http.NewRequest("GET", mediaURL, nil)
 	if err != nil {
-		p.l.Panicf("Unable to get object %v from GCS: %v\n", filename, err)
+		return nil, err
 	}
-	resp, err := p.client.Get(obj.MediaLink)
+	resp, err := p.client.Do(req.WithContext(ctx))
 	if err != nil {
-		p.l.Panicf("Unable to download %v: %v\n", obj.MediaLink, err)
+		return nil, fmt.Errorf("unable to download %v: %v", mediaURL, err)
 	}
-	defer resp.Body.Close()
-	b, err = ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("download of %v returned %v", mediaURL, resp.Status)
+	}
+	return resp.Body, nil
+}
+
+// imagemagickTransform runs ImageMagick's convert as a subprocess, piping in as its stdin and
+// streaming out as its stdout, so no temporary files ever touch disk.
+type imagemagickTransform struct {
+	// convertArgs are the operation flags for this variant, e.g. {"-thumbnail", "100x100"}.
+	convertArgs []string
+}
+
+// Apply implements Transform.
+func (t *imagemagickTransform) Apply(ctx context.Context, in io.Reader, out io.Writer) error {
+	args := append([]string{"-"}, t.convertArgs...)
+	args = append(args, "jpg:-")
+	cmd := exec.CommandContext(ctx, "convert", args...)
+	cmd.Stdin = in
+	cmd.Stdout = out
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("convert failed: %v (stderr: %v)", err, stderr.String())
+	}
+	return nil
+}
+
+// newImagemagickBackend returns the thumbnail/moderate/intense variants implemented via
+// ImageMagick's convert, matching the transforms this worker has always applied.
+func newImagemagickBackend() map[string]Transform {
+	return map[string]Transform{
+		// thumbnail applies a simple resize. It should take well under a second to process on an
+		// n1-standard-1 machine.
+		"thumbnail": &imagemagickTransform{convertArgs: []string{"-thumbnail", "100x100"}},
+		// moderate applies several basic transformations before resizing. It should take about 1s
+		// to process on an n1-standard-1 machine.
+		"moderate": &imagemagickTransform{convertArgs: []string{
+			"-auto-orient", "-antialias", "-contrast", "-thumbnail", "100x100"}},
+		// intense applies many CPU intensive transformations before resizing. It should take
+		// about 7.8s to process on an n1-standard-1 machine.
+		"intense": &imagemagickTransform{convertArgs: []string{
+			"-auto-level", "-auto-orient", "-antialias", "-auto-gamma", "-contrast", "-despeckle",
+			"-thumbnail", "100x100"}},
+	}
+}
+
+// vipsLevel selects how much of imagemagickTransform's per-variant processing a vipsTransform
+// approximates; each level does everything the one before it does, plus more.
+type vipsLevel int
+
+const (
+	vipsLevelThumbnail vipsLevel = iota
+	vipsLevelModerate
+	vipsLevelIntense
+)
+
+// vipsTransform applies a transform using libvips via govips. libvips processes images in a
+// streaming fashion and uses roughly an order of magnitude less memory/CPU than shelling out to
+// ImageMagick for thumbnailing, which matters when the autoscaler is sizing VMs to CPU load.
+//
+// govips has no direct equivalent for some of imagemagickTransform's flags (notably -auto-level
+// and -auto-gamma, which pick their parameters from the image's own histogram; libvips' Gamma
+// takes a fixed exponent instead), so level's moderate/intense output approximates, rather than
+// exactly matches, the imagemagick variants of the same name. Apply also always auto-rotates,
+// unlike imagemagickTransform's "thumbnail" (whose convertArgs omit -auto-orient), so even
+// "thumbnail" isn't pixel-identical across backends for a source image with EXIF orientation set.
+//
+// Apply reads the whole source image into memory before decoding it, and encodes the whole
+// output before writing it to out, so unlike imagemagickTransform it does not stream.
+type vipsTransform struct {
+	level vipsLevel
+}
+
+// Apply implements Transform.
+func (t *vipsTransform) Apply(ctx context.Context, in io.Reader, out io.Writer) error {
+	b, err := ioutil.ReadAll(in)
 	if err != nil {
-		p.l.Panicf("Unable to read body of %v: %v\n", obj.MediaLink, err)
+		return fmt.Errorf("unable to buffer source image: %v", err)
 	}
-	return
+	img, err := vips.NewImageFromBuffer(b)
+	if err != nil {
+		return fmt.Errorf("unable to decode source image: %v", err)
+	}
+	defer img.Close()
+
+	if err := img.AutoRotate(); err != nil {
+		return fmt.Errorf("unable to auto-rotate image: %v", err)
+	}
+	if t.level >= vipsLevelModerate {
+		// Linear1 approximates -contrast's mild, fixed contrast stretch.
+		if err := img.Linear1(1.1, -8); err != nil {
+			return fmt.Errorf("unable to adjust contrast: %v", err)
+		}
+	}
+	if t.level >= vipsLevelIntense {
+		// Median approximates -despeckle; Gamma approximates -auto-gamma with a fixed exponent,
+		// since libvips has no auto-gamma equivalent to pick one from the image's histogram.
+		if err := img.Median(3); err != nil {
+			return fmt.Errorf("unable to despeckle image: %v", err)
+		}
+		if err := img.Gamma(1.0 / 2.2); err != nil {
+			return fmt.Errorf("unable to adjust gamma: %v", err)
+		}
+		if err := img.Sharpen(1.0, 1.0, 2.0); err != nil {
+			return fmt.Errorf("unable to sharpen image: %v", err)
+		}
+	}
+	if err := img.Thumbnail(100, 100, vips.InterestingNone); err != nil {
+		return fmt.Errorf("unable to thumbnail image: %v", err)
+	}
+
+	buf, _, err := img.ExportJpeg(nil)
+	if err != nil {
+		return fmt.Errorf("unable to encode output image: %v", err)
+	}
+	_, err = out.Write(buf)
+	return err
 }
 
-// getThumbnailCommand returns a simple imagemagick command which resizes the indicated image into
-// a 100x100 thumbnail.
-func thumbnailCommand(in, out string) *exec.Cmd {
-	return exec.Command("convert", in, "-thumbnail", "100x100", out)
+// newVipsBackend returns the thumbnail/moderate/intense variants implemented via libvips, each
+// approximating (see vipsTransform) its imagemagick counterpart of the same name.
+func newVipsBackend() map[string]Transform {
+	return map[string]Transform{
+		"thumbnail": &vipsTransform{level: vipsLevelThumbnail},
+		"moderate":  &vipsTransform{level: vipsLevelModerate},
+		"intense":   &vipsTransform{level: vipsLevelIntense},
+	}
 }
 
-// getIntenseCommand returns an imagemagick command which applies many CPU intensive
-// transformations to the indicated image before resizing it into a 100x100 thumbnail. It should
-// take about 7.8s to process on an n1-standard-1 machine.
-func intenseCommand(in, out string) *exec.Cmd {
-	return exec.Command("convert", in, "-auto-level", "-auto-orient", "-antialias",
-		"-auto-gamma", "-contrast", "-despeckle", "-thumbnail", "100x100", out)
+// newTransformBackend returns the named backend's variant registry, defaulting to imagemagick for
+// an unrecognized name.
+func newTransformBackend(name string) map[string]Transform {
+	if name == "vips" {
+		return newVipsBackend()
+	}
+	return newImagemagickBackend()
 }
 
-// getModerateCommand returns a an imagemagick command which applies several basic transformations
-// to an image before resizing to a 100x100 thumbnail. It should take about 1s to process on an
-// n1-standard-1 machine.
-func moderateCommand(in, out string) *exec.Cmd {
-	return exec.Command("convert", in, "-auto-orient", "-antialias", "-contrast", "-thumbnail",
-		"100x100", out)
+// ProcessImageStreaming applies a transformation to the indicated image without ever buffering
+// the whole image in memory or writing it to local disk: the GCS download is piped directly into
+// ImageMagick's stdin, and ImageMagick's stdout is piped into a resumable upload as it is
+// produced. This bounds worker memory use on large images and means a preemptible VM can be
+// killed mid-request without leaving temp files behind. That memory bound holds for the
+// imagemagick backend only: with the vips backend, vipsTransform holds the whole source image
+// and its encoded output in memory.
+func (p *imageProcessor) ProcessImageStreaming(ctx context.Context, r processImageReq) (err error) {
+	ev := telemetry.Event{
+		TraceID:      r.traceID,
+		SourceBucket: r.sourceBucket,
+		SourceObject: r.filename,
+		Attempt:      r.attempt,
+		Hostname:     hostname,
+	}
+	defer func() {
+		ev.Status = "success"
+		if err != nil {
+			ev.Status = "error"
+		}
+		p.telemetry.Log(ev)
+		p.metrics.PublishLatencies(time.Duration(ev.DownloadMs)*time.Millisecond, time.Duration(ev.ProcessMs)*time.Millisecond)
+	}()
+
+	transform, ok := p.transforms[r.transform]
+	if !ok {
+		return fmt.Errorf("unknown transform %q", r.transform)
+	}
+
+	srcObj, err := p.s.Objects.Get(r.sourceBucket, r.filename).Do()
+	if err != nil {
+		return fmt.Errorf("unable to get source object metadata for %v: %v", r.filename, err)
+	}
+
+	if cached, hit := p.cache.Lookup(r.saveToBucket, srcObj.Crc32c, r.transform); hit {
+		p.l.Printf("Cache hit for %v (variant %v); copying %v to %v\n", r.filename, r.transform,
+			cached.Name, r.saveToFilename)
+		if err = p.cache.CopyToFinal(r.saveToBucket, cached, r.saveToFilename); err != nil {
+			return fmt.Errorf("unable to copy cached thumbnail to %v: %v", r.saveToFilename, err)
+		}
+		return nil
+	}
+
+	tDownload := time.Now()
+	src, err := p.openSource(ctx, r, srcObj)
+	ev.DownloadMs = int64(time.Since(tDownload) / time.Millisecond)
+	if err != nil {
+		return fmt.Errorf("unable to open source image: %v", err)
+	}
+	defer src.Close()
+	countingSrc := &telemetry.CountingReader{R: src}
+
+	// Adapt transform.Apply, which writes to an io.Writer, onto resumableUpload, which reads from
+	// an io.Reader, so bytes stream straight from the transform to the upload without ever being
+	// buffered in full. Because convert and upload run concurrently over the pipe, their elapsed
+	// wall-clock time is indistinguishable; ev.ProcessMs below records that shared duration rather
+	// than fabricating a convert/upload split.
+	pr, pw := io.Pipe()
+	countingDst := &telemetry.CountingWriter{W: pw}
+	applyErrCh := make(chan error, 1)
+	go func() {
+		applyErrCh <- transform.Apply(ctx, countingSrc, countingDst)
+		pw.Close()
+	}()
+
+	cacheName := p.cache.key(srcObj.Crc32c, r.transform)
+	p.l.Printf("Streaming %v to resumable upload at %v/%v\n", r.filename, r.saveToBucket, cacheName)
+	tProcess := time.Now()
+	uploadErr := p.resumableUpload(ctx, r.saveToBucket, cacheName, pr)
+	ev.ProcessMs = int64(time.Since(tProcess) / time.Millisecond)
+	ev.BytesIn = countingSrc.N
+	ev.BytesOut = countingDst.N
+	if applyErr := <-applyErrCh; applyErr != nil {
+		return fmt.Errorf("transform %q failed: %v", r.transform, applyErr)
+	}
+	if uploadErr != nil {
+		return fmt.Errorf("unable to upload %v to GCS: %v", cacheName, uploadErr)
+	}
+
+	if err = p.cache.PromoteToFinal(r.saveToBucket, srcObj.Crc32c, r.transform, r.saveToFilename); err != nil {
+		return fmt.Errorf("unable to promote %v to %v: %v", cacheName, r.saveToFilename, err)
+	}
+	p.l.Printf("Converted and uploaded %s to %s/%s (cached as %s)\n", r.filename, r.saveToBucket,
+		r.saveToFilename, cacheName)
+	return nil
 }
 
-// processImage applies a transformation to the indicated image and writes its output to a given
-// GCS bucket. It works in several steps:
-// 1. Retrieve the image's data from GCS.
-// 2. Downloads the image.
-// 3. Uses Imagemagick to compute a transformation on the image.
-// 4. Uploads the resulting image to GCS.
-func (p *imageProcessor) processImage(r processImageReq) (err error) {
-	// Copy the file to VM's attached Persistent Disk for image conversion
-	b := p.getImageBytes(r.sourceBucket, r.filename)
-	p.l.Printf("Read %d bytes from response body...\n", len(b))
+// uploadChunkSize is the unit resumableUpload reads and PUTs in at a time, bounding how much of
+// the transform's output it ever buffers in memory at once. It must be a multiple of GCS's
+// 256KiB resumable-upload chunk granularity (the final chunk of an upload is exempt).
+const uploadChunkSize = 8 << 20 // 8MiB
 
-	if err = ioutil.WriteFile(r.filename, b, 0600); err != nil {
-		p.l.Printf("Error writing file %v to disk\n", r.filename)
-		return
+// resumableUpload uploads the contents of in to saveToBucket/saveToFilename using the GCS JSON
+// API's resumable upload protocol (uploadType=resumable): it first POSTs to obtain a session URI,
+// then PUTs the body in uploadChunkSize chunks via Content-Range, so it never buffers more than
+// one chunk of the transform's output at a time. A chunk PUT that fails transiently is retried
+// with the exact same bytes by the imageProcessor's retrytransport-backed client; this worker
+// doesn't separately query the session URI for its received offset before resuming.
+func (p *imageProcessor) resumableUpload(ctx context.Context, saveToBucket, saveToFilename string, in io.Reader) error {
+	sessionURI, err := p.startResumableSession(ctx, saveToBucket, saveToFilename)
+	if err != nil {
+		return fmt.Errorf("unable to start resumable session: %v", err)
 	}
-	defer os.Remove(r.filename) // Cleanup input file after we transform it.
 
-	cmd := moderateCommand(r.filename, r.saveToFilename)
+	buf := make([]byte, uploadChunkSize)
+	var offset int64
+	for {
+		n, readErr := io.ReadFull(in, buf)
+		if readErr != nil && readErr != io.EOF && readErr != io.ErrUnexpectedEOF {
+			return fmt.Errorf("unable to read convert output: %v", readErr)
+		}
+		final := readErr == io.EOF || readErr == io.ErrUnexpectedEOF
+		total := int64(-1)
+		if final {
+			total = offset + int64(n)
+		}
+		if n > 0 || final {
+			if err := p.putChunk(ctx, sessionURI, buf[:n], offset, total); err != nil {
+				return err
+			}
+		}
+		offset += int64(n)
+		if final {
+			return nil
+		}
+	}
+}
 
-	out, err := cmd.CombinedOutput()
+// putChunk PUTs a single chunk of resumableUpload's body at the given offset to sessionURI,
+// identifying it with a GCS resumable-upload Content-Range header. total is the overall upload
+// size once the final chunk is known, or -1 while more chunks remain.
+func (p *imageProcessor) putChunk(ctx context.Context, sessionURI string, chunk []byte, offset, total int64) error {
+	totalStr := "*"
+	if total >= 0 {
+		totalStr = strconv.FormatInt(total, 10)
+	}
+	contentRange := fmt.Sprintf("bytes %d-%d/%s", offset, offset+int64(len(chunk))-1, totalStr)
+	if len(chunk) == 0 {
+		contentRange = fmt.Sprintf("bytes */%s", totalStr)
+	}
+	req, err := http.NewRequest("PUT", sessionURI, bytes.NewReader(chunk))
 	if err != nil {
-		p.l.Printf("Could not transform file. StdOut: %v\n", string(out))
-		return
-	} else {
-		p.l.Printf("Converted %s to %s\n", r.filename, r.saveToFilename)
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Range", contentRange)
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusCreated:
+		return nil
+	case http.StatusPermanentRedirect: // "Resume Incomplete": this chunk was accepted, more expected.
+		if total < 0 {
+			return nil
+		}
+		fallthrough
+	default:
+		out, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("resumable PUT of %v returned %v: %s", contentRange, resp.Status, out)
 	}
-	defer os.Remove(r.saveToFilename) // Clean up after ourselves.
+}
 
-	// Upload the converted image file to Cloud Storage output bucket
-	p.l.Println("Now starting upload to save-to Cloud Storage Bucket...")
-	object := &storage.Object{Name: r.saveToFilename}
-	file, err := os.Open(r.saveToFilename)
+// startResumableSession initiates a resumable upload session for the given object and returns the
+// session URI the chunked PUTs should be sent to.
+func (p *imageProcessor) startResumableSession(ctx context.Context, bucket, name string) (string, error) {
+	u := fmt.Sprintf("https://www.googleapis.com/upload/storage/v1/b/%s/o?uploadType=resumable", bucket)
+	object := &storage.Object{Name: name}
+	b, err := object.MarshalJSON()
 	if err != nil {
-		p.l.Printf("Error opening %q\n", r.saveToFilename)
-		return
+		return "", err
 	}
-	defer file.Close()
-	res, err := p.s.Objects.Insert(r.saveToBucket, object).Media(file).Do()
+	req, err := http.NewRequest("POST", u, bytes.NewReader(b))
 	if err != nil {
-		p.l.Printf("Unable to upload %v to GCS\n", r.saveToFilename)
+		return "", err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json; charset=UTF-8")
+	req.Header.Set("X-Upload-Content-Type", "application/octet-stream")
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("session POST returned %v", resp.Status)
+	}
+	loc := resp.Header.Get("Location")
+	if loc == "" {
+		return "", errors.New("response did not include a resumable session Location")
 	}
-	p.l.Printf("Created object %v at location %v\n", res.Name, res.SelfLink)
-	return
+	return loc, nil
 }
 
 // NewImageProcessor constructs an imageProcessor which listens for input on the provided channel
-// and logs to stderr with its name as the prefix.
-func NewImageProcessor(c <-chan processImageReq, name string) *imageProcessor {
+// and logs to stderr with its name as the prefix. Successfully processed requests are
+// acknowledged against subscription via ps. transforms is the backend-specific variant registry
+// shared by all processors in this binary.
+func NewImageProcessor(c <-chan processImageReq, ps *pubsub.Service, subscription, name string, transforms map[string]Transform) *imageProcessor {
 	client, err := serviceaccount.NewClient(&serviceaccount.Options{
-		Transport: &RetryTransport{http.DefaultTransport, 5},
+		Transport: retrytransport.New(http.DefaultTransport, 5),
 	})
 	if err != nil {
 		log.Panicf("Failed to create service account client: %v\n", err)
@@ -276,32 +680,69 @@ func NewImageProcessor(c <-chan processImageReq, name string) *imageProcessor {
 	if err != nil {
 		log.Panicf("Failed to create GCS client: %v\n", err)
 	}
+	monitoringService, err := monitoring.New(client)
+	if err != nil {
+		log.Panicf("Failed to create Cloud Monitoring client: %v\n", err)
+	}
+	logger := log.New(os.Stderr, name, log.LstdFlags)
 	return &imageProcessor{
-		c:      c,
-		client: client,
-		s:      service,
-		l:      log.New(os.Stderr, name, log.LstdFlags),
+		c:            c,
+		client:       client,
+		s:            service,
+		ps:           ps,
+		subscription: subscription,
+		cache:        NewThumbnailCache(service),
+		transforms:   transforms,
+		telemetry:    telemetry.NewLogger(os.Stdout),
+		metrics:      telemetry.NewMetricsPublisher(monitoringService, *project, name, logger),
+		l:            logger,
 	}
-
 }
 
 // healthHandler writes an HTTP 200 response indicating general system healthiness.
 func healthHandler(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintf(w, "hostname=%s\n", hostname)
+	fmt.Fprintf(w, "backend=%s\n", *backendFlag)
 	w.WriteHeader(http.StatusOK)
 }
 
 func main() {
+	flag.Parse()
 	var err error
 	hostname, err = os.Hostname()
 	if err != nil {
 		log.Fatalf("Failed to get hostname: %v.\n", err)
 	}
-	h := NewImagemagickHandler(ImageProcessQueueSize, NumImageProcessors)
-	http.Handle("/process", h)
-	http.HandleFunc("/healthcheck", healthHandler)
-	err = http.ListenAndServe(":80", nil)
+	if *subscription == "" {
+		log.Fatalf("--subscription is required.\n")
+	}
 
+	if *backendFlag == "vips" {
+		vips.Startup(nil)
+		defer vips.Shutdown()
+	}
+	transforms := newTransformBackend(*backendFlag)
+
+	client, err := serviceaccount.NewClient(&serviceaccount.Options{
+		Transport: retrytransport.New(http.DefaultTransport, 5),
+	})
 	if err != nil {
+		log.Fatalf("Failed to create service account client: %v\n", err)
+	}
+	ps, err := pubsub.New(client)
+	if err != nil {
+		log.Fatalf("Failed to create Pub/Sub client: %v\n", err)
+	}
+
+	c := make(chan processImageReq, ImageProcessQueueSize)
+	for i := 0; i < NumImageProcessors; i++ {
+		p := NewImageProcessor(c, ps, *subscription, fmt.Sprintf("Processor(%d)", i), transforms)
+		go p.process()
+	}
+	go NewPullSubscriber(c, ps, *subscription, ImageProcessQueueSize).run()
+
+	http.HandleFunc("/healthcheck", healthHandler)
+	if err := http.ListenAndServe(":80", nil); err != nil {
 		log.Fatalf("Failed to start server: %v", err)
 	}
 }
@@ -0,0 +1,184 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package retrytransport provides an http.RoundTripper that retries requests against Google APIs
+// with truncated exponential backoff and full jitter, shared by the compute worker and the
+// duplicate-files script. The App Engine app does not use it.
+package retrytransport
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+var (
+	// A map of HTTP response codes which we consider to be retryable.
+	retryableCodes = map[int]bool{
+		http.StatusForbidden:           true,
+		http.StatusInternalServerError: true,
+		http.StatusBadGateway:          true,
+		http.StatusServiceUnavailable:  true,
+		http.StatusGatewayTimeout:      true,
+	}
+	// retryable403Reasons holds the GCS JSON API error reasons that indicate a 403 is a transient
+	// rate limit rather than a permanent auth failure.
+	retryable403Reasons = map[string]bool{
+		"rateLimitExceeded":     true,
+		"userRateLimitExceeded": true,
+	}
+)
+
+const (
+	// retryBaseDelay and retryCapDelay parameterize the truncated exponential backoff: sleep =
+	// rand(0, min(retryCapDelay, retryBaseDelay*2^attempt)).
+	retryBaseDelay = 500 * time.Millisecond
+	retryCapDelay  = 32 * time.Second
+)
+
+// RetryTransport wraps another http.RoundTripper and provides for sending HTTP requests up to
+// maxTries times in total (the first attempt plus up to maxTries-1 retries), backing off between
+// attempts. Retries are aborted promptly if the request's
+// context is cancelled.
+type RetryTransport struct {
+	http.RoundTripper
+	maxTries int
+}
+
+// New constructs a RetryTransport which makes up to maxTries attempts per request.
+func New(rt http.RoundTripper, maxTries int) *RetryTransport {
+	return &RetryTransport{rt, maxTries}
+}
+
+// RoundTrip implements the http.RoundTripper interface and will attempt to retry an HTTP request
+// if the response contains a retryable status code, sleeping between attempts with truncated
+// exponential backoff and full jitter, honoring any Retry-After header the server sends.
+func (t *RetryTransport) RoundTrip(req *http.Request) (resp *http.Response, err error) {
+	var body []byte
+	if req.Body != nil {
+		body, err = ioutil.ReadAll(req.Body)
+		if err != nil {
+			return
+		}
+	}
+	ctx := req.Context()
+	var wait time.Duration
+	for i := 0; i < t.maxTries; i++ {
+		if i != 0 {
+			// Build a new request and back off before retrying.
+			req = copyRequest(req, body)
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(wait):
+			}
+		}
+		resp, err = t.RoundTripper.RoundTrip(req)
+		if err != nil {
+			wait = backoffDelay(i)
+			continue
+		}
+		if !retryableCodes[resp.StatusCode] {
+			break // Success, or a non-retryable failure.
+		}
+
+		// Drain and restore the body (rather than just closing it) on every retryable status,
+		// not only 403: this may be the last attempt, in which case this response is what gets
+		// returned to the caller, and callers like googleapi.CheckResponse and putChunk decode
+		// the error body to report what actually went wrong.
+		respBody, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		resp.Body = ioutil.NopCloser(bytes.NewReader(respBody))
+		if resp.StatusCode == http.StatusForbidden {
+			// A 403 is often a permanent auth/permission error; only retry the rate-limit
+			// flavors, which the JSON error body's "reason" field distinguishes.
+			if !has403RetryableReason(respBody) {
+				break
+			}
+		}
+
+		if ra := resp.Header.Get("Retry-After"); ra != "" {
+			wait = parseRetryAfter(ra)
+		} else {
+			wait = backoffDelay(i)
+		}
+	}
+	return
+}
+
+// copyRequest constructs a new HTTP request mirroring the provided one with the given body.
+func copyRequest(req *http.Request, body []byte) *http.Request {
+	nreq, err := http.NewRequest(req.Method, req.URL.String(), bytes.NewReader(body))
+	if err != nil {
+		log.Panicf("Unable to copy http request: %v", err)
+	}
+	nreq = nreq.WithContext(req.Context())
+	for k, vv := range req.Header {
+		vv2 := make([]string, len(vv))
+		copy(vv2, vv)
+		nreq.Header[k] = vv2
+	}
+	return nreq
+}
+
+// has403RetryableReason reports whether a GCS JSON API error body names one of the rate-limit
+// error reasons we're willing to retry. An unparseable body is treated as non-retryable, since a
+// permanent auth failure is the more common cause of a 403.
+func has403RetryableReason(body []byte) bool {
+	var e struct {
+		Error struct {
+			Errors []struct {
+				Reason string `json:"reason"`
+			} `json:"errors"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(body, &e); err != nil {
+		return false
+	}
+	for _, sub := range e.Error.Errors {
+		if retryable403Reasons[sub.Reason] {
+			return true
+		}
+	}
+	return false
+}
+
+// backoffDelay returns a truncated-exponential-with-full-jitter delay for the given zero-indexed
+// attempt number.
+func backoffDelay(attempt int) time.Duration {
+	d := retryBaseDelay << uint(attempt)
+	if d <= 0 || d > retryCapDelay {
+		d = retryCapDelay
+	}
+	return time.Duration(rand.Int63n(int64(d)))
+}
+
+// parseRetryAfter parses a Retry-After header value, which may be either a number of seconds or
+// an HTTP date. It returns 0 if the value can't be parsed.
+func parseRetryAfter(v string) time.Duration {
+	if secs, err := strconv.Atoi(v); err == nil {
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
@@ -27,6 +27,7 @@ import (
 	"sync"
 
 	"code.google.com/p/google-api-go-client/storage/v1"
+	"github.com/GoogleCloudPlatform/httplb-autoscaling-go/retrytransport"
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
 )
@@ -60,15 +61,11 @@ func getObjects(s *storage.Service, b string) (objs []*storage.Object) {
 	return
 }
 
-// copyObjects copies the source file to the destination in Google Cloud Storage.
-// It returns an error if one occurred.
+// copyObject copies the source file to the destination in Google Cloud Storage. It returns an
+// error if one occurred; transient failures are retried by the service's retrytransport-backed
+// HTTP client, so a single call here is sufficient.
 func copyObject(s *storage.Service, sourceBucket, sourceName, destBucket, destName string) (err error) {
-	// Try 3 times to copy.
-	for i := 0; i <= 3; i++ {
-		if _, err = s.Objects.Copy(sourceBucket, sourceName, destBucket, destName, nil).Do(); err == nil {
-			break
-		}
-	}
+	_, err = s.Objects.Copy(sourceBucket, sourceName, destBucket, destName, nil).Do()
 	return
 }
 
@@ -93,7 +90,9 @@ func main() {
 	if err != nil {
 		log.Fatalf("Could not build JWT config: %v\n", err)
 	}
-	service, err := storage.New(conf.Client(oauth2.NoContext))
+	client := conf.Client(oauth2.NoContext)
+	client.Transport = retrytransport.New(client.Transport, 5)
+	service, err := storage.New(client)
 	if err != nil {
 		log.Fatalf("Failed to create GCS client: %v\n", err)
 	}